@@ -0,0 +1,133 @@
+// Command docker-shim is exec'd as the direct parent of a container's
+// process. It holds the master end of the container's PTY so that the
+// container survives the daemon being killed or restarted: the daemon
+// only ever talks to it through the stdin, stdout and resize fifos and
+// exit.fifo left behind in its directory, never by holding the child
+// itself.
+//
+// Usage: docker-shim <dir> <cmd> [arg...]
+//
+// Layout of <dir>; the fifos are created ahead of time by the daemon,
+// the pid file by the shim itself:
+//
+//	stdin       fifo; attachers write here, it's relayed into the PTY
+//	stdout      fifo; everything read from the PTY is relayed here
+//	resize      fifo; "cols rows\n" lines are applied to the PTY size
+//	exit.fifo   fifo; the child's exit code is written here once, at exit
+//	pid         plain file; the child's pid, written once it has started
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"syscall"
+
+	"github.com/kr/pty"
+)
+
+func main() {
+	if len(os.Args) < 3 {
+		fmt.Fprintln(os.Stderr, "Usage: docker-shim <dir> <cmd> [arg...]")
+		os.Exit(1)
+	}
+	dir := os.Args[1]
+	cmd := exec.Command(os.Args[2], os.Args[3:]...)
+
+	master, err := pty.Start(cmd)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "pid"), []byte(strconv.Itoa(cmd.Process.Pid)), 0644); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+	}
+
+	go relayStdin(filepath.Join(dir, "stdin"), master)
+	go relayStdout(filepath.Join(dir, "stdout"), master)
+	go relayResize(filepath.Join(dir, "resize"), master)
+
+	code := 0
+	if err := cmd.Wait(); err != nil {
+		code = 1
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			if status, ok := exitErr.Sys().(syscall.WaitStatus); ok {
+				code = status.ExitStatus()
+			}
+		}
+	}
+	writeExit(filepath.Join(dir, "exit.fifo"), code)
+}
+
+// relayStdin reopens the stdin fifo for every new attacher and copies
+// whatever it sends into the PTY master.
+func relayStdin(path string, master io.Writer) {
+	for {
+		f, err := os.OpenFile(path, os.O_RDONLY, 0)
+		if err != nil {
+			return
+		}
+		io.Copy(master, f)
+		f.Close()
+	}
+}
+
+// relayStdout copies everything read from the PTY master into the
+// stdout fifo, reopening it once a reader disconnects so the next
+// attacher (or the daemon after a restart) can pick the stream back up.
+func relayStdout(path string, master io.Reader) {
+	buf := make([]byte, 32*1024)
+	for {
+		f, err := os.OpenFile(path, os.O_WRONLY, 0)
+		if err != nil {
+			return
+		}
+		for {
+			n, rerr := master.Read(buf)
+			if n > 0 {
+				if _, werr := f.Write(buf[:n]); werr != nil {
+					break
+				}
+			}
+			if rerr != nil {
+				f.Close()
+				return
+			}
+		}
+		f.Close()
+	}
+}
+
+// relayResize reopens the resize fifo for every new attacher and
+// applies each "cols rows\n" line it sends to the PTY size.
+func relayResize(path string, master *os.File) {
+	for {
+		f, err := os.OpenFile(path, os.O_RDONLY, 0)
+		if err != nil {
+			return
+		}
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			var cols, rows uint16
+			if _, err := fmt.Sscanf(scanner.Text(), "%d %d", &cols, &rows); err == nil {
+				pty.Setsize(master, &pty.Winsize{Rows: rows, Cols: cols})
+			}
+		}
+		f.Close()
+	}
+}
+
+func writeExit(path string, code int) {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	fmt.Fprintf(f, "%d\n", code)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io"
+	"sync"
+)
+
+// logBufferSize bounds how much historical output writeBroadcaster keeps
+// per stream. Once full, the oldest bytes are dropped.
+const logBufferSize = 1 << 16 // 64kB
+
+// writeBroadcaster fans a single stream of writes out to any number of
+// subscribers, while also keeping a bounded ring buffer of everything
+// written so far. CmdLogs replays the buffer; CmdAttach registers a new
+// subscriber to receive everything written from then on.
+type writeBroadcaster struct {
+	mu      sync.Mutex
+	buf     []byte
+	writers map[io.WriteCloser]struct{}
+}
+
+func newWriteBroadcaster() *writeBroadcaster {
+	return &writeBroadcaster{writers: make(map[io.WriteCloser]struct{})}
+}
+
+func (w *writeBroadcaster) AddWriter(writer io.WriteCloser) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.writers[writer] = struct{}{}
+}
+
+func (w *writeBroadcaster) RemoveWriter(writer io.WriteCloser) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.writers, writer)
+}
+
+func (w *writeBroadcaster) Write(p []byte) (n int, err error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.buf = append(w.buf, p...)
+	if len(w.buf) > logBufferSize {
+		w.buf = w.buf[len(w.buf)-logBufferSize:]
+	}
+	for writer := range w.writers {
+		if _, err := writer.Write(p); err != nil {
+			delete(w.writers, writer)
+		}
+	}
+	return len(p), nil
+}
+
+// Bytes returns a copy of the buffered history.
+func (w *writeBroadcaster) Bytes() []byte {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	out := make([]byte, len(w.buf))
+	copy(out, w.buf)
+	return out
+}
+
+func (w *writeBroadcaster) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	for writer := range w.writers {
+		writer.Close()
+	}
+	w.writers = make(map[io.WriteCloser]struct{})
+	return nil
+}
+
+// nopCloser adapts an io.Writer (such as the HTTP response writer) to
+// io.WriteCloser so it can subscribe to a writeBroadcaster without the
+// broadcaster's Close() tearing down the underlying connection.
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error { return nil }
@@ -4,23 +4,23 @@ import (
 	"errors"
 	"log"
 	"io"
-	"net/http"
-	"net/url"
+	"os"
 	"os/exec"
+	"syscall"
 	"flag"
 	"reflect"
 	"fmt"
-	"github.com/kr/pty"
-	"path"
+	"path/filepath"
 	"strings"
 	"time"
 	"math/rand"
 	"crypto/sha256"
 	"bytes"
 	"text/tabwriter"
+	"github.com/boltdb/bolt"
 )
 
-func (docker *Docker) CmdHelp(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+func (docker *Docker) CmdHelp(stdin io.ReadCloser, stdout, stderr io.Writer, args ...string) (int, error) {
 	log.Printf("Help %s\n", args)
 	if len(args) == 0 {
 		fmt.Fprintf(stdout, "Usage: docker COMMAND [arg...]\n\nA self-sufficient runtime for linux containers.\n\nCommands:\n")
@@ -30,8 +30,10 @@ func (docker *Docker) CmdHelp(stdin io.ReadCloser, stdout io.Writer, args ...str
 			{"list", "Display a list of containers"},
 			{"layers", "Display a list of layers"},
 			{"get", "Download a layer from a remote location"},
+			{"import", "Import a layer from a tar stream"},
 			{"wait", "Wait for the state of a container to change"},
 			{"stop", "Stop a running container"},
+			{"rm", "Remove a container"},
 			{"logs", "Fetch the logs of a container"},
 			{"export", "Extract changes to a container's filesystem into a new layer"},
 			{"attach", "Attach to the standard inputs and outputs of a running container"},
@@ -40,22 +42,22 @@ func (docker *Docker) CmdHelp(stdin io.ReadCloser, stdout io.Writer, args ...str
 			fmt.Fprintf(stdout, "    %-10.10s%s\n", cmd...)
 		}
 	} else {
-		if method := docker.getMethod(args[0]); method == nil {
-			return errors.New("No such command: " + args[0])
-		} else {
-			method(stdin, stdout, "--help")
+		method := docker.getMethod(args[0])
+		if method == nil {
+			return 1, errors.New("No such command: " + args[0])
 		}
+		method(stdin, stdout, stderr, "--help")
 	}
-	return nil
+	return 0, nil
 }
 
-func (docker *Docker) CmdLayers(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+func (docker *Docker) CmdLayers(stdin io.ReadCloser, stdout, stderr io.Writer, args ...string) (int, error) {
 	flags := Subcmd(stdout, "layers", "[OPTIONS] [NAME]", "Show available filesystem layers")
 	quiet := flags.Bool("q", false, "Quiet mode")
 	flags.Parse(args)
 	if flags.NArg() > 1 {
 		flags.Usage()
-		return nil
+		return 0, nil
 	}
 	var nameFilter string
 	if flags.NArg() == 1 {
@@ -79,59 +81,101 @@ func (docker *Docker) CmdLayers(stdin io.ReadCloser, stdout io.Writer, args ...s
 		}
 		w.Flush()
 	}
-	return nil
+	return 0, nil
 }
 
-func (docker *Docker) CmdGet(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+func (docker *Docker) CmdGet(stdin io.ReadCloser, stdout, stderr io.Writer, args ...string) (int, error) {
 	if len(args) < 1 {
-		return errors.New("Not enough arguments")
+		return 1, errors.New("Not enough arguments")
 	}
+	defer stdin.Close()
 	fmt.Fprintf(stdout, "Downloading from %s...\n", args[0])
-	time.Sleep(2 * time.Second)
-	layer := docker.addLayer(args[0], "download", 0)
+	layer, err := docker.storeLayer(stdin, args[0], "download", "")
+	if err != nil {
+		return 1, err
+	}
 	fmt.Fprintf(stdout, "New layer: %s %s %.1fM\n", layer.Id, layer.Name, float32(layer.Size) / 1024 / 1024)
-	return nil
+	return 0, nil
 }
 
-func (docker *Docker) CmdPut(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+func (docker *Docker) CmdImport(stdin io.ReadCloser, stdout, stderr io.Writer, args ...string) (int, error) {
 	if len(args) < 1 {
-		return errors.New("Not enough arguments")
+		return 1, errors.New("Not enough arguments")
+	}
+	defer stdin.Close()
+	layer, err := docker.storeLayer(stdin, args[0], "import", "")
+	if err != nil {
+		return 1, err
 	}
-	time.Sleep(1 * time.Second)
-	layer := docker.addLayer(args[0], "upload", 0)
 	fmt.Fprintf(stdout, "New layer: %s %s %.1fM\n", layer.Id, layer.Name, float32(layer.Size) / 1024 / 1024)
-	return nil
+	return 0, nil
+}
+
+func (docker *Docker) CmdPut(stdin io.ReadCloser, stdout, stderr io.Writer, args ...string) (int, error) {
+	if len(args) < 1 {
+		return 1, errors.New("Not enough arguments")
+	}
+	defer stdin.Close()
+	layer, err := docker.storeLayer(stdin, args[0], "upload", "")
+	if err != nil {
+		return 1, err
+	}
+	fmt.Fprintf(stdout, "New layer: %s %s %.1fM\n", layer.Id, layer.Name, float32(layer.Size) / 1024 / 1024)
+	return 0, nil
 }
 
-func (docker *Docker) CmdExport(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+func (docker *Docker) CmdExport(stdin io.ReadCloser, stdout, stderr io.Writer, args ...string) (int, error) {
 	flags := Subcmd(stdout,
 		"export", "CONTAINER LAYER",
 		"Create a new layer from the changes on a container's filesystem")
-	_ = flags.Bool("s", false, "Stream the new layer to the client intead of storing it on the docker")
+	stream := flags.Bool("s", false, "Stream the new layer to the client intead of storing it on the docker")
 	if err := flags.Parse(args); err != nil {
-		return nil
+		return 0, nil
 	}
 	if flags.NArg() < 2 {
-		return errors.New("Not enough arguments")
+		return 1, errors.New("Not enough arguments")
 	}
-	if container, exists := docker.containers[flags.Arg(0)]; !exists {
-		return errors.New("No such container")
-	} else {
-		// Extract actual changes here
-		layer := docker.addLayer(flags.Arg(1), "export:" + container.Id, container.BytesChanged)
-		fmt.Fprintf(stdout, "New layer: %s %s %.1fM\n", layer.Id, layer.Name, float32(layer.Size) / 1024 / 1024)
+	container, exists := docker.containers[flags.Arg(0)]
+	if !exists {
+		return 1, errors.New("No such container")
 	}
-	return nil
+	if *stream {
+		filesChanged, bytesChanged, err := diffLayer(container.Rootfs, container.Mounted, stdout)
+		if err != nil {
+			return 1, err
+		}
+		container.FilesChanged = filesChanged
+		container.BytesChanged = bytesChanged
+		if err := docker.saveContainer(container); err != nil {
+			return 1, err
+		}
+		return 0, nil
+	}
+	var filesChanged, bytesChanged uint
+	pr, pw := io.Pipe()
+	go func() {
+		var err error
+		filesChanged, bytesChanged, err = diffLayer(container.Rootfs, container.Mounted, pw)
+		pw.CloseWithError(err)
+	}()
+	layer, err := docker.storeLayer(pr, flags.Arg(1), "export:" + container.Id, lastLayerId(container.Layers))
+	if err != nil {
+		return 1, err
+	}
+	container.FilesChanged = filesChanged
+	container.BytesChanged = bytesChanged
+	if err := docker.saveContainer(container); err != nil {
+		return 1, err
+	}
+	fmt.Fprintf(stdout, "New layer: %s %s %.1fM\n", layer.Id, layer.Name, float32(layer.Size) / 1024 / 1024)
+	return 0, nil
 }
 
-
-func (docker *Docker) addLayer(name string, source string, size uint) Layer {
-	if size == 0 {
-		size = uint(rand.Int31n(142 * 1024 * 1024))
+func lastLayerId(layers []Layer) string {
+	if len(layers) == 0 {
+		return ""
 	}
-	layer := Layer{Id: randomId(), Name: name, Source: source, Added: time.Now(), Size: size}
-	docker.layers[layer.Id] = layer
-	return layer
+	return layers[len(layers) - 1].Id
 }
 
 type ArgList []string
@@ -145,31 +189,30 @@ func (l *ArgList) String() string {
 	return strings.Join(*l, ",")
 }
 
-func (docker *Docker) CmdRun(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+func (docker *Docker) CmdRun(stdin io.ReadCloser, stdout, stderr io.Writer, args ...string) (int, error) {
 	flags := Subcmd(stdout, "run", "-l LAYER [-l LAYER...] COMMAND {ARG...]", "Run a command in a container")
 	fl_layers := new(ArgList)
 	flags.Var(fl_layers, "l", "Add a layer to the filesystem. Multiple layers are added in the order they are defined")
 	if err := flags.Parse(args); err != nil {
-		return nil
+		return 0, nil
 	}
 	if len(*fl_layers) < 1 {
-		return errors.New("Please specify at least one layer")
+		return 1, errors.New("Please specify at least one layer")
 	}
 	if flags.NArg() < 1 {
-		return errors.New("No command specified")
+		return 1, errors.New("No command specified")
 	}
 	cmd := flags.Arg(0)
 	var cmd_args []string
 	if flags.NArg() > 1 {
 		cmd_args = flags.Args()[1:]
 	}
-	container := Container{
+	container := &Container{
 		Id:	randomId(),
 		Cmd:	cmd,
 		Args:	cmd_args,
 		Created: time.Now(),
-		FilesChanged: uint(rand.Int31n(42)),
-		BytesChanged: uint(rand.Int31n(24 * 1024 * 1024)),
+		docker: docker,
 	}
 	for _, name := range *fl_layers {
 		if layer, exists := docker.layers[name]; !exists {
@@ -178,57 +221,50 @@ func (docker *Docker) CmdRun(stdin io.ReadCloser, stdout io.Writer, args ...stri
 					container.Layers = append(container.Layers, layer)
 				}
 			} else {
-				return errors.New("No such layer or container: " + name)
+				return 1, errors.New("No such layer or container: " + name)
 			}
 		} else {
 			container.Layers = append(container.Layers, layer)
 		}
 	}
+	container.Dir = filepath.Join(ContainersRoot, container.Id)
+	container.Rootfs = filepath.Join(container.Dir, "rootfs")
+	if err := mountLayers(container.Layers, container.Rootfs); err != nil {
+		return 1, err
+	}
+	container.Mounted = time.Now()
 	docker.containers[container.Id] = container
-	return container.Run(stdin, stdout)
+	if err := docker.saveContainer(container); err != nil {
+		return 1, err
+	}
+	if err := container.Run(stdin, stdout); err != nil {
+		return 1, err
+	}
+	if err := docker.saveContainer(container); err != nil {
+		return 1, err
+	}
+	return 0, nil
 }
 
-func (docker *Docker) CmdClone(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+func (docker *Docker) CmdClone(stdin io.ReadCloser, stdout, stderr io.Writer, args ...string) (int, error) {
 	flags := Subcmd(stdout, "Clone", "[OPTIONS] CONTAINER_ID", "Duplicate a container")
 	reset := flags.Bool("r", true, "Reset: don't keep filesystem changes from the source container")
 	flags.Parse(args)
 	if !*reset {
-		return errors.New("Only reset mode is available for now. Please use -r")
+		return 1, errors.New("Only reset mode is available for now. Please use -r")
 	}
 	if flags.NArg() != 1 {
 		flags.Usage()
-		return nil
+		return 0, nil
 	}
 	container, exists := docker.containers[flags.Arg(0)];
 	if !exists {
-		return errors.New("No such container: " + flags.Arg(0))
-	}
-	return docker.CmdRun(stdin, stdout, append([]string{"-l", container.Id, "--", container.Cmd}, container.Args...)...)
-}
-
-func startCommand(cmd *exec.Cmd, interactive bool) (io.WriteCloser, io.ReadCloser, error) {
-	if interactive {
-		term, err := pty.Start(cmd)
-		if err != nil {
-			return nil, nil, err
-		}
-		return term, term, nil
-	}
-	stdin, err := cmd.StdinPipe()
-	if err != nil {
-		return nil, nil, err
-	}
-	stdout, err := cmd.StdoutPipe()
-	if err != nil {
-		return nil, nil, err
-	}
-	if err := cmd.Start(); err != nil {
-		return nil, nil, err
+		return 1, errors.New("No such container: " + flags.Arg(0))
 	}
-	return stdin, stdout, nil
+	return docker.CmdRun(stdin, stdout, stderr, append([]string{"-l", container.Id, "--", container.Cmd}, container.Args...)...)
 }
 
-func (docker *Docker) CmdList(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+func (docker *Docker) CmdList(stdin io.ReadCloser, stdout, stderr io.Writer, args ...string) (int, error) {
 	var longestCol int
 	for _, container := range docker.containers {
 		if l := len(container.CmdString()); l > longestCol {
@@ -255,54 +291,123 @@ func (docker *Docker) CmdList(stdin io.ReadCloser, stdout io.Writer, args ...str
 			/* CHANGES */	fmt.Sprintf("%.1fM", float32(container.BytesChanged) / 1024 / 1024),
 			/* LAYERS */	strings.Join(layers, ", "))
 	}
-	return nil
+	return 0, nil
 }
 
-func main() {
-	rand.Seed(time.Now().UTC().UnixNano())
-	flag.Parse()
-	if err := http.ListenAndServe(":4242", New()); err != nil {
-		log.Fatal(err)
+func (docker *Docker) CmdLogs(stdin io.ReadCloser, stdout, stderr io.Writer, args ...string) (int, error) {
+	if len(args) < 1 {
+		return 1, errors.New("Not enough arguments")
 	}
+	container, exists := docker.containers[args[0]]
+	if !exists {
+		return 1, errors.New("No such container: " + args[0])
+	}
+	if container.Stdout != nil {
+		stdout.Write(container.Stdout.Bytes())
+	}
+	return 0, nil
 }
 
-func New() *Docker {
-	return &Docker{
-		layers: make(map[string]Layer),
-		containers: make(map[string]Container),
+func (docker *Docker) CmdAttach(stdin io.ReadCloser, stdout, stderr io.Writer, args ...string) (int, error) {
+	if len(args) < 1 {
+		return 1, errors.New("Not enough arguments")
+	}
+	container, exists := docker.containers[args[0]]
+	if !exists {
+		return 1, errors.New("No such container: " + args[0])
+	}
+	if !container.Running {
+		return 1, errors.New("Container not running: " + args[0])
 	}
+	subscriber := nopCloser{stdout}
+	container.Stdout.AddWriter(subscriber)
+	defer container.Stdout.RemoveWriter(subscriber)
+	if r, ok := stdin.(resizer); ok {
+		done := make(chan struct{})
+		defer close(done)
+		go container.relayResize(r.Resize(), done)
+	}
+	in, err := os.OpenFile(filepath.Join(container.Dir, "stdin"), os.O_WRONLY, 0)
+	if err == nil {
+		defer in.Close()
+		io.Copy(in, stdin)
+	}
+	return 0, nil
 }
 
-type AutoFlush struct {
-	http.ResponseWriter
+func (docker *Docker) CmdWait(stdin io.ReadCloser, stdout, stderr io.Writer, args ...string) (int, error) {
+	if len(args) < 1 {
+		return 1, errors.New("Not enough arguments")
+	}
+	container, exists := docker.containers[args[0]]
+	if !exists {
+		return 1, errors.New("No such container: " + args[0])
+	}
+	if container.waitCh != nil {
+		<-container.waitCh
+	}
+	fmt.Fprintf(stdout, "%d\n", container.ExitCode)
+	return 0, nil
 }
 
-func (w *AutoFlush) Write(data []byte) (int, error) {
-	ret, err := w.ResponseWriter.Write(data)
-	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
-		flusher.Flush()
+func (docker *Docker) CmdRm(stdin io.ReadCloser, stdout, stderr io.Writer, args ...string) (int, error) {
+	if len(args) < 1 {
+		return 1, errors.New("Not enough arguments")
+	}
+	container, exists := docker.containers[args[0]]
+	if !exists {
+		return 1, errors.New("No such container: " + args[0])
+	}
+	if container.Running {
+		return 1, errors.New("Container is running, stop it first: " + args[0])
 	}
-	return ret, err
+	if err := docker.deleteContainer(args[0]); err != nil {
+		return 1, err
+	}
+	if err := os.RemoveAll(container.Dir); err != nil {
+		return 1, err
+	}
+	delete(docker.containers, args[0])
+	fmt.Fprintf(stdout, "%s\n", args[0])
+	return 0, nil
 }
 
-func (docker *Docker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	cmd, args := URLToCall(r.URL)
-	log.Printf("%s\n", strings.Join(append(append([]string{"docker"}, cmd), args...), " "))
-	if cmd == "" {
-		docker.CmdUsage(r.Body, w, "")
-		return
-	}
-	method := docker.getMethod(cmd)
-	if method == nil {
-		docker.CmdUsage(r.Body, w, cmd)
-	} else {
-		err := method(r.Body, &AutoFlush{w}, args...)
-		if err != nil {
-			fmt.Fprintf(w, "Error: %s\n", err)
-		}
+func main() {
+	rand.Seed(time.Now().UTC().UnixNano())
+	root := flag.String("root", "/var/lib/docker", "Path to use as the root of the docker runtime")
+	host := flag.String("H", "tcp://:4242", "Address to listen on (tcp://host:port or unix:///path/to/socket)")
+	flag.Parse()
+	docker, err := New(*root)
+	if err != nil {
+		log.Fatal(err)
 	}
+	log.Fatal(docker.Serve(*host))
 }
 
+func New(root string) (*Docker, error) {
+	LayersRoot = filepath.Join(root, "layers")
+	ContainersRoot = filepath.Join(root, "containers")
+	if err := os.MkdirAll(LayersRoot, 0755); err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(ContainersRoot, 0755); err != nil {
+		return nil, err
+	}
+	db, err := openStore(root)
+	if err != nil {
+		return nil, err
+	}
+	docker := &Docker{
+		layers: make(map[string]Layer),
+		containers: make(map[string]*Container),
+		db: db,
+	}
+	if err := docker.loadState(); err != nil {
+		return nil, err
+	}
+	docker.reattachShims()
+	return docker, nil
+}
 
 func (docker *Docker) getMethod(name string) Cmd {
 	methodName := "Cmd"+strings.ToUpper(name[:1])+strings.ToLower(name[1:])
@@ -310,31 +415,26 @@ func (docker *Docker) getMethod(name string) Cmd {
 	if !exists {
 		return nil
 	}
-	return func(stdin io.ReadCloser, stdout io.Writer, args ...string) error {
+	return func(stdin io.ReadCloser, stdout, stderr io.Writer, args ...string) (int, error) {
 		ret := method.Func.CallSlice([]reflect.Value{
 			reflect.ValueOf(docker),
 			reflect.ValueOf(stdin),
 			reflect.ValueOf(stdout),
+			reflect.ValueOf(stderr),
 			reflect.ValueOf(args),
-		})[0].Interface()
-		if ret == nil {
-			return nil
+		})
+		code := int(ret[0].Int())
+		if errVal := ret[1].Interface(); errVal != nil {
+			return code, errVal.(error)
 		}
-		return ret.(error)
+		return code, nil
 	}
 }
 
-func Go(f func() error) chan error {
-	ch := make(chan error)
-	go func() {
-		ch <- f()
-	}()
-	return ch
-}
-
 type Docker struct {
 	layers		map[string]Layer
-	containers	map[string]Container
+	containers	map[string]*Container
+	db		*bolt.DB
 }
 
 type Layer struct {
@@ -343,6 +443,7 @@ type Layer struct {
 	Added	time.Time
 	Size	uint
 	Source	string
+	Parent	string
 }
 
 type Container struct {
@@ -354,40 +455,48 @@ type Container struct {
 	FilesChanged uint
 	BytesChanged uint
 	Running	bool
+	Rootfs	string
+	Mounted	time.Time
+	Dir	string
+	ShimPid	int
+	ExitCode int
+	Stdout	*writeBroadcaster `json:"-"`
+	waitCh	chan struct{}
+	docker	*Docker
 }
 
+// Run starts the container under a docker-shim: the shim becomes the
+// child's direct parent and outlives the daemon, so Run itself returns
+// as soon as the shim is launched rather than blocking for the whole
+// lifetime of the container. stdin is closed once the shim is launched;
+// stdout is subscribed to Stdout and gets the container's output for as
+// long as writes to it succeed. Output is read back from the shim's
+// stdout fifo and fanned out by Stdout.
 func (c *Container) Run(stdin io.ReadCloser, stdout io.Writer) error {
-	// Not thread-safe
 	if c.Running {
 		return errors.New("Already running")
 	}
-	c.Running = true
-	defer func() { c.Running = false }()
-	cmd := exec.Command(c.Cmd, c.Args...)
-	cmd_stdin, cmd_stdout, err := startCommand(cmd, false)
-	if err != nil {
+	if err := os.MkdirAll(c.Dir, 0755); err != nil {
 		return err
 	}
-	copy_out := Go(func() error {
-		_, err := io.Copy(stdout, cmd_stdout)
-		return err
-	})
-	copy_in := Go(func() error {
-		//_, err := io.Copy(cmd_stdin, stdin)
-		cmd_stdin.Close()
-		stdin.Close()
-		//return err
-		return nil
-	})
-	if err := cmd.Wait(); err != nil {
-		return err
+	for _, name := range []string{"stdin", "stdout", "resize", "exit.fifo"} {
+		syscall.Mkfifo(filepath.Join(c.Dir, name), 0600)
 	}
-	if err := <-copy_in; err != nil {
-		return err
-	}
-	if err := <-copy_out; err != nil {
+	args := append([]string{c.Dir, c.Cmd}, c.Args...)
+	cmd := exec.Command(shimPath(), args...)
+	cmd.Dir = c.Rootfs
+	if err := cmd.Start(); err != nil {
 		return err
 	}
+	c.ShimPid = cmd.Process.Pid
+	c.Running = true
+	c.Stdout = newWriteBroadcaster()
+	c.Stdout.AddWriter(nopCloser{stdout})
+	c.waitCh = make(chan struct{})
+	cmd.Process.Release()
+	go c.relayStdout()
+	go c.waitExit()
+	stdin.Close()
 	return nil
 }
 
@@ -395,17 +504,8 @@ func (c *Container) CmdString() string {
 	return strings.Join(append([]string{c.Cmd}, c.Args...), " ")
 }
 
-type Cmd func(io.ReadCloser, io.Writer, ...string) error
-type CmdMethod func(*Docker, io.ReadCloser, io.Writer, ...string) error
-
-// Use this key to encode an RPC call into an URL,
-// eg. domain.tld/path/to/method?q=get_user&q=gordon
-const ARG_URL_KEY = "q"
-
-func URLToCall(u *url.URL) (method string, args []string) {
-	return path.Base(u.Path), u.Query()[ARG_URL_KEY]
-}
-
+type Cmd func(io.ReadCloser, io.Writer, io.Writer, ...string) (int, error)
+type CmdMethod func(*Docker, io.ReadCloser, io.Writer, io.Writer, ...string) (int, error)
 
 func randomBytes() io.Reader {
 	return bytes.NewBuffer([]byte(fmt.Sprintf("%x", rand.Int())))
@@ -457,4 +557,3 @@ func Subcmd(output io.Writer, name, signature, description string) *flag.FlagSet
 	}
 	return flags
 }
-
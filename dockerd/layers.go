@@ -0,0 +1,228 @@
+package main
+
+import (
+	"archive/tar"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// LayersRoot and ContainersRoot are where the layer store and container
+// rootfs trees live on disk. Both are overridden by the -root flag on
+// the daemon.
+var (
+	LayersRoot     = "/var/lib/docker/layers"
+	ContainersRoot = "/var/lib/docker/containers"
+)
+
+func layerDir(id string) string {
+	return filepath.Join(LayersRoot, id)
+}
+
+// storeLayer reads a tar stream from r, writes it to disk under a
+// content-addressed directory keyed by the sha256 of the stream, and
+// unpacks it into a "rootfs" subdirectory. Metadata is written
+// alongside as layer.json and saved to the daemon's store, which is
+// where New() reloads it from.
+func (docker *Docker) storeLayer(r io.Reader, name, source, parent string) (Layer, error) {
+	tmp, err := ioutil.TempFile(LayersRoot, "layer-")
+	if err != nil {
+		return Layer{}, err
+	}
+	defer os.Remove(tmp.Name())
+	h := sha256.New()
+	size, err := io.Copy(io.MultiWriter(tmp, h), r)
+	tmp.Close()
+	if err != nil {
+		return Layer{}, err
+	}
+	id := fmt.Sprintf("%x", h.Sum(nil))[:16]
+	dir := layerDir(id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return Layer{}, err
+	}
+	tarPath := filepath.Join(dir, "layer.tar")
+	if err := os.Rename(tmp.Name(), tarPath); err != nil {
+		return Layer{}, err
+	}
+	if err := unpackTar(tarPath, filepath.Join(dir, "rootfs")); err != nil {
+		return Layer{}, err
+	}
+	layer := Layer{
+		Id:     id,
+		Name:   name,
+		Source: source,
+		Added:  time.Now(),
+		Size:   uint(size),
+		Parent: parent,
+	}
+	if err := writeLayerMeta(dir, layer); err != nil {
+		return Layer{}, err
+	}
+	docker.layers[layer.Id] = layer
+	if err := docker.saveLayer(layer); err != nil {
+		return Layer{}, err
+	}
+	return layer, nil
+}
+
+func writeLayerMeta(dir string, layer Layer) error {
+	f, err := os.Create(filepath.Join(dir, "layer.json"))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return json.NewEncoder(f).Encode(layer)
+}
+
+func readLayerMeta(dir string) (Layer, error) {
+	f, err := os.Open(filepath.Join(dir, "layer.json"))
+	if err != nil {
+		return Layer{}, err
+	}
+	defer f.Close()
+	var layer Layer
+	err = json.NewDecoder(f).Decode(&layer)
+	return layer, err
+}
+
+func unpackTar(tarPath, dest string) error {
+	f, err := os.Open(tarPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, hdr.Name)
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			if err := os.MkdirAll(target, os.FileMode(hdr.Mode)); err != nil {
+				return err
+			}
+		case tar.TypeSymlink:
+			os.Symlink(hdr.Linkname, target)
+		default:
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			out, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, os.FileMode(hdr.Mode))
+			if err != nil {
+				return err
+			}
+			if _, err := io.Copy(out, tr); err != nil {
+				out.Close()
+				return err
+			}
+			out.Close()
+		}
+	}
+}
+
+// mountLayers assembles a container's rootfs by stacking each of its
+// layers on top of each other, lowest first. Until there's a real
+// union filesystem (aufs/overlay) wired in, this is a plain recursive
+// copy of each layer's unpacked tree.
+func mountLayers(layers []Layer, dest string) error {
+	if err := os.MkdirAll(dest, 0755); err != nil {
+		return err
+	}
+	for _, layer := range layers {
+		if err := copyTree(filepath.Join(layerDir(layer.Id), "rootfs"), dest); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copyTree(src, dest string) error {
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		return nil
+	}
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dest, rel)
+		if info.IsDir() {
+			return os.MkdirAll(target, info.Mode())
+		}
+		in, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer in.Close()
+		out, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, info.Mode())
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+		_, err = io.Copy(out, in)
+		return err
+	})
+}
+
+// diffLayer walks a container's rootfs and tars up every file that was
+// modified after since, producing a layer containing only the changes
+// made on top of its parent layers. It returns the number of files and
+// bytes written to the tar, so callers can record real change stats
+// instead of fabricating them.
+func diffLayer(rootfs string, since time.Time, w io.Writer) (filesChanged uint, bytesChanged uint, err error) {
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+	if _, statErr := os.Stat(rootfs); os.IsNotExist(statErr) {
+		return 0, 0, nil
+	}
+	err = filepath.Walk(rootfs, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !info.ModTime().After(since) {
+			return nil
+		}
+		rel, err := filepath.Rel(rootfs, path)
+		if err != nil {
+			return err
+		}
+		hdr, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		hdr.Name = rel
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		n, err := io.Copy(tw, f)
+		if err != nil {
+			return err
+		}
+		filesChanged++
+		bytesChanged += uint(n)
+		return nil
+	})
+	return filesChanged, bytesChanged, err
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func tarOf(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range files {
+		hdr := &tar.Header{Name: name, Mode: 0644, Size: int64(len(content))}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatalf("tar header: %v", err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatalf("tar write: %v", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatalf("tar close: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func newTestDocker(t *testing.T) *Docker {
+	t.Helper()
+	root := t.TempDir()
+	LayersRoot = filepath.Join(root, "layers")
+	ContainersRoot = filepath.Join(root, "containers")
+	if err := os.MkdirAll(LayersRoot, 0755); err != nil {
+		t.Fatalf("MkdirAll: %v", err)
+	}
+	db, err := openStore(root)
+	if err != nil {
+		t.Fatalf("openStore: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return &Docker{
+		layers:     make(map[string]Layer),
+		containers: make(map[string]*Container),
+		db:         db,
+	}
+}
+
+func TestStoreLayerUnpacksAndRecordsMeta(t *testing.T) {
+	docker := newTestDocker(t)
+	data := tarOf(t, map[string]string{"a.txt": "hello"})
+
+	layer, err := docker.storeLayer(bytes.NewReader(data), "base", "test", "")
+	if err != nil {
+		t.Fatalf("storeLayer: %v", err)
+	}
+	if layer.Size != uint(len(data)) {
+		t.Fatalf("layer.Size = %d, want %d", layer.Size, len(data))
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(layerDir(layer.Id), "rootfs", "a.txt"))
+	if err != nil {
+		t.Fatalf("reading unpacked file: %v", err)
+	}
+	if string(got) != "hello" {
+		t.Fatalf("unpacked content = %q, want %q", got, "hello")
+	}
+
+	meta, err := readLayerMeta(layerDir(layer.Id))
+	if err != nil {
+		t.Fatalf("readLayerMeta: %v", err)
+	}
+	if meta.Id != layer.Id || meta.Name != "base" {
+		t.Fatalf("readLayerMeta = %+v, want Id=%s Name=base", meta, layer.Id)
+	}
+}
+
+func TestDiffLayerOnlyReportsChangesSinceMount(t *testing.T) {
+	docker := newTestDocker(t)
+	data := tarOf(t, map[string]string{"a.txt": "hello"})
+	layer, err := docker.storeLayer(bytes.NewReader(data), "base", "test", "")
+	if err != nil {
+		t.Fatalf("storeLayer: %v", err)
+	}
+
+	dest := filepath.Join(t.TempDir(), "rootfs")
+	if err := mountLayers([]Layer{layer}, dest); err != nil {
+		t.Fatalf("mountLayers: %v", err)
+	}
+
+	baseTime := time.Now().Add(-time.Hour)
+	if err := os.Chtimes(filepath.Join(dest, "a.txt"), baseTime, baseTime); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+	since := baseTime.Add(time.Minute)
+
+	if err := ioutil.WriteFile(filepath.Join(dest, "b.txt"), []byte("new!"), 0644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	newTime := since.Add(time.Minute)
+	if err := os.Chtimes(filepath.Join(dest, "b.txt"), newTime, newTime); err != nil {
+		t.Fatalf("Chtimes: %v", err)
+	}
+
+	var buf bytes.Buffer
+	filesChanged, bytesChanged, err := diffLayer(dest, since, &buf)
+	if err != nil {
+		t.Fatalf("diffLayer: %v", err)
+	}
+	if filesChanged != 1 {
+		t.Fatalf("filesChanged = %d, want 1 (the untouched base file must not be reported)", filesChanged)
+	}
+	if bytesChanged != uint(len("new!")) {
+		t.Fatalf("bytesChanged = %d, want %d", bytesChanged, len("new!"))
+	}
+
+	tr := tar.NewReader(&buf)
+	hdr, err := tr.Next()
+	if err != nil {
+		t.Fatalf("reading diff tar: %v", err)
+	}
+	if hdr.Name != "b.txt" {
+		t.Fatalf("diff tar contains %q, want b.txt", hdr.Name)
+	}
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Stream tags for the framed attach protocol. Every frame on the wire
+// is a 4-byte big-endian length prefix, a 1-byte stream tag, then that
+// many bytes of payload.
+const (
+	streamStdin  = 0
+	streamStdout = 1
+	streamStderr = 2
+	streamExit   = 3
+	streamResize = 4
+)
+
+// maxFrameSize bounds how large a single frame's payload is allowed to
+// be. Every transport (the unix socket listener and the hijacked
+// tcp/"/attach" path) is unauthenticated, so the length prefix can't be
+// trusted to allocate whatever it says without a cap.
+const maxFrameSize = 32 * 1024 * 1024 // 32MB
+
+// frameMux serializes writes from any number of output streams onto a
+// single underlying connection, each tagged so a client can tell stdout
+// apart from stderr and the eventual exit-code frame without needing a
+// side channel.
+type frameMux struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (m *frameMux) writeFrame(tag byte, p []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	hdr := make([]byte, 5)
+	binary.BigEndian.PutUint32(hdr[:4], uint32(len(p)))
+	hdr[4] = tag
+	if _, err := m.w.Write(hdr); err != nil {
+		return err
+	}
+	_, err := m.w.Write(p)
+	return err
+}
+
+// Stream returns an io.Writer that frames every write under the given
+// stream tag.
+func (m *frameMux) Stream(tag byte) io.Writer {
+	return frameStream{m, tag}
+}
+
+type frameStream struct {
+	mux *frameMux
+	tag byte
+}
+
+func (s frameStream) Write(p []byte) (int, error) {
+	if err := s.mux.writeFrame(s.tag, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func readFrame(r io.Reader) (tag byte, payload []byte, err error) {
+	hdr := make([]byte, 5)
+	if _, err = io.ReadFull(r, hdr); err != nil {
+		return
+	}
+	n := binary.BigEndian.Uint32(hdr[:4])
+	tag = hdr[4]
+	if n > maxFrameSize {
+		err = fmt.Errorf("frame too large: %d bytes (max %d)", n, maxFrameSize)
+		return
+	}
+	payload = make([]byte, n)
+	_, err = io.ReadFull(r, payload)
+	return
+}
+
+// demux reads frames off r until it hits an error (typically EOF once
+// the client hangs up), forwarding stdin frames into stdinW and resize
+// frames onto resize. The send onto resize is non-blocking: most
+// commands never read it (only CmdAttach does), and a blocking send
+// there would wedge this whole read loop — stdin included — behind a
+// resize frame nobody is listening for.
+func demux(r io.Reader, stdinW io.WriteCloser, resize chan<- [2]uint16) {
+	defer stdinW.Close()
+	for {
+		tag, payload, err := readFrame(r)
+		if err != nil {
+			return
+		}
+		switch tag {
+		case streamStdin:
+			stdinW.Write(payload)
+		case streamResize:
+			if len(payload) == 4 && resize != nil {
+				select {
+				case resize <- [2]uint16{binary.BigEndian.Uint16(payload[0:2]), binary.BigEndian.Uint16(payload[2:4])}:
+				default:
+				}
+			}
+		}
+	}
+}
+
+// resizer is implemented by the stdin handed to a Cmd when the caller
+// negotiated resize frames over the framed protocol. Commands that
+// care about terminal size (CmdAttach) type-assert for it; commands
+// that don't just see a plain io.ReadCloser.
+type resizer interface {
+	Resize() <-chan [2]uint16
+}
+
+type stdinWithResize struct {
+	io.ReadCloser
+	resize <-chan [2]uint16
+}
+
+func (s *stdinWithResize) Resize() <-chan [2]uint16 { return s.resize }
+
+// serveConn runs a single framed RPC call: a JSON array with the
+// command and its arguments on the first line read from reader, then
+// stdin/resize frames flowing in over reader and stdout/stderr/
+// exit-code frames flowing out over w. reader must be the same
+// buffered reader the caller used to read off the connection (or wrap
+// it directly, before anything else reads from it) — re-wrapping the
+// raw connection in a fresh bufio.Reader after some data has already
+// been buffered elsewhere (e.g. by net/http before a Hijack) silently
+// drops whatever was buffered.
+func serveConn(docker *Docker, closer io.Closer, reader *bufio.Reader, w io.Writer) {
+	defer closer.Close()
+	line, err := reader.ReadString('\n')
+	if err != nil {
+		return
+	}
+	var argv []string
+	if err := json.Unmarshal([]byte(strings.TrimSpace(line)), &argv); err != nil || len(argv) == 0 {
+		return
+	}
+	name, args := argv[0], argv[1:]
+	method := docker.getMethod(name)
+	if method == nil {
+		method = docker.getMethod("help")
+		args = []string{name}
+	}
+	mux := &frameMux{w: w}
+	stdinR, stdinW := io.Pipe()
+	resize := make(chan [2]uint16, 1)
+	go demux(reader, stdinW, resize)
+	stdin := &stdinWithResize{stdinR, resize}
+	code, err := method(stdin, &AutoFlush{mux.Stream(streamStdout)}, &AutoFlush{mux.Stream(streamStderr)}, args...)
+	if err != nil {
+		fmt.Fprintf(mux.Stream(streamStderr), "Error: %s\n", err)
+		if code == 0 {
+			code = 1
+		}
+	}
+	exitPayload := make([]byte, 4)
+	binary.BigEndian.PutUint32(exitPayload, uint32(code))
+	mux.writeFrame(streamExit, exitPayload)
+}
+
+// serveListener accepts connections on l and runs serveConn on each.
+// This is the transport behind a unix:// -H flag.
+func serveListener(docker *Docker, l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go serveConn(docker, conn, bufio.NewReader(conn), conn)
+	}
+}
+
+// attachHandler serves the framed protocol over a hijacked HTTP
+// connection at /attach, for daemons listening on tcp://.
+func (docker *Docker) attachHandler(w http.ResponseWriter, r *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, rw, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(conn, "HTTP/1.1 200 OK\r\nContent-Type: application/vnd.docker.raw-stream\r\n\r\n")
+	serveConn(docker, conn, rw.Reader, conn)
+}
+
+func (docker *Docker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path == "/attach" {
+		docker.attachHandler(w, r)
+		return
+	}
+	http.NotFound(w, r)
+}
+
+// Serve starts accepting connections on host, which is either
+// tcp://addr (HTTP, framed RPC served at /attach) or
+// unix:///path/to/socket (the framed RPC served directly).
+func (docker *Docker) Serve(host string) error {
+	proto, addr := splitHost(host)
+	if proto == "unix" {
+		os.Remove(addr)
+		l, err := net.Listen("unix", addr)
+		if err != nil {
+			return err
+		}
+		return serveListener(docker, l)
+	}
+	return http.ListenAndServe(addr, docker)
+}
+
+func splitHost(host string) (proto, addr string) {
+	if parts := strings.SplitN(host, "://", 2); len(parts) == 2 {
+		return parts[0], parts[1]
+	}
+	return "tcp", host
+}
+
+// AutoFlush wraps a writer and flushes after every write when the
+// underlying writer implements http.Flusher, so streamed output isn't
+// held up waiting for a buffer to fill. The frame streams serveConn
+// wraps write straight to the connection and are not flushers, so
+// there AutoFlush passes writes through unchanged.
+type AutoFlush struct {
+	io.Writer
+}
+
+func (w *AutoFlush) Write(data []byte) (int, error) {
+	ret, err := w.Writer.Write(data)
+	if flusher, ok := w.Writer.(http.Flusher); ok {
+		flusher.Flush()
+	}
+	return ret, err
+}
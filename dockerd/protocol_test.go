@@ -0,0 +1,42 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFrameRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	mux := &frameMux{w: &buf}
+	if err := mux.writeFrame(streamStdout, []byte("hello")); err != nil {
+		t.Fatalf("writeFrame: %v", err)
+	}
+	if err := mux.writeFrame(streamStderr, []byte("")); err != nil {
+		t.Fatalf("writeFrame (empty payload): %v", err)
+	}
+
+	tag, payload, err := readFrame(&buf)
+	if err != nil {
+		t.Fatalf("readFrame: %v", err)
+	}
+	if tag != streamStdout || string(payload) != "hello" {
+		t.Fatalf("got tag=%d payload=%q, want tag=%d payload=%q", tag, payload, streamStdout, "hello")
+	}
+
+	tag, payload, err = readFrame(&buf)
+	if err != nil {
+		t.Fatalf("readFrame: %v", err)
+	}
+	if tag != streamStderr || len(payload) != 0 {
+		t.Fatalf("got tag=%d payload=%q, want tag=%d empty payload", tag, payload, streamStderr)
+	}
+}
+
+func TestReadFrameRejectsOversizedLength(t *testing.T) {
+	var buf bytes.Buffer
+	hdr := []byte{0xff, 0xff, 0xff, 0xff, streamStdin}
+	buf.Write(hdr)
+	if _, _, err := readFrame(&buf); err == nil {
+		t.Fatal("expected readFrame to reject a length prefix above maxFrameSize, got nil error")
+	}
+}
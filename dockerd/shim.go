@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// shimPath locates the docker-shim binary: next to the daemon's own
+// binary if possible, falling back to $PATH.
+func shimPath() string {
+	if exe, err := os.Executable(); err == nil {
+		if candidate := filepath.Join(filepath.Dir(exe), "docker-shim"); fileExists(candidate) {
+			return candidate
+		}
+	}
+	if p, err := exec.LookPath("docker-shim"); err == nil {
+		return p
+	}
+	return "docker-shim"
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(path)
+	return err == nil
+}
+
+// relayStdout reads everything the shim writes to the container's
+// stdout fifo and fans it out through c.Stdout, so CmdLogs/CmdAttach
+// keep working exactly as before even though the daemon is no longer
+// the container's direct parent.
+func (c *Container) relayStdout() {
+	f, err := os.OpenFile(filepath.Join(c.Dir, "stdout"), os.O_RDONLY, 0)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	io.Copy(c.Stdout, f)
+	c.Stdout.Close()
+}
+
+// waitExit blocks until the shim reports an exit status on exit.fifo,
+// records it, wakes up any CmdWait callers, and persists the final
+// state so it survives a daemon restart.
+func (c *Container) waitExit() {
+	data, _ := ioutil.ReadFile(filepath.Join(c.Dir, "exit.fifo"))
+	code, _ := strconv.Atoi(strings.TrimSpace(string(data)))
+	c.ExitCode = code
+	c.Running = false
+	close(c.waitCh)
+	if c.docker != nil {
+		c.docker.saveContainer(c)
+	}
+}
+
+// relayResize forwards every dims update off resize into the
+// container's resize fifo, where docker-shim picks it up and applies
+// it to the PTY. It exits once done is closed (the attacher hung up)
+// or resize is closed.
+func (c *Container) relayResize(resize <-chan [2]uint16, done <-chan struct{}) {
+	for {
+		select {
+		case dims, ok := <-resize:
+			if !ok {
+				return
+			}
+			f, err := os.OpenFile(filepath.Join(c.Dir, "resize"), os.O_WRONLY, 0)
+			if err != nil {
+				continue
+			}
+			fmt.Fprintf(f, "%d %d\n", dims[0], dims[1])
+			f.Close()
+		case <-done:
+			return
+		}
+	}
+}
+
+// reattachShims is called on daemon startup. Any container whose shim
+// is still alive is wired back up to fresh broadcasters and wait
+// channels instead of being marked stopped, so a container survives a
+// daemon restart. Containers loaded from the store never have docker
+// set, since it isn't part of the persisted JSON.
+func (docker *Docker) reattachShims() {
+	for _, container := range docker.containers {
+		container.docker = docker
+		if container.ShimPid == 0 || !processAlive(container.ShimPid) {
+			container.ShimPid = 0
+			container.Running = false
+			docker.saveContainer(container)
+			continue
+		}
+		container.Running = true
+		container.Stdout = newWriteBroadcaster()
+		container.waitCh = make(chan struct{})
+		go container.relayStdout()
+		go container.waitExit()
+	}
+}
+
+func processAlive(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	proc, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	return proc.Signal(syscall.Signal(0)) == nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"path/filepath"
+)
+
+var (
+	layersBucket     = []byte("layers")
+	containersBucket = []byte("containers")
+)
+
+// openStore opens (creating if necessary) the daemon's on-disk bolt
+// database under root, making sure both top-level buckets exist.
+func openStore(root string) (*bolt.DB, error) {
+	db, err := bolt.Open(filepath.Join(root, "docker.db"), 0600, nil)
+	if err != nil {
+		return nil, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		if _, err := tx.CreateBucketIfNotExists(layersBucket); err != nil {
+			return err
+		}
+		_, err := tx.CreateBucketIfNotExists(containersBucket)
+		return err
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+func (docker *Docker) saveLayer(layer Layer) error {
+	data, err := json.Marshal(layer)
+	if err != nil {
+		return err
+	}
+	return docker.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(layersBucket).Put([]byte(layer.Id), data)
+	})
+}
+
+func (docker *Docker) saveContainer(container *Container) error {
+	data, err := json.Marshal(container)
+	if err != nil {
+		return err
+	}
+	return docker.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(containersBucket).Put([]byte(container.Id), data)
+	})
+}
+
+func (docker *Docker) deleteContainer(id string) error {
+	return docker.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(containersBucket).Delete([]byte(id))
+	})
+}
+
+// loadState repopulates docker.layers and docker.containers from the
+// on-disk store. Containers are always reloaded as not running;
+// reattachShims, run by New() afterwards, marks those whose shim is
+// still alive as running again.
+func (docker *Docker) loadState() error {
+	return docker.db.View(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(layersBucket).ForEach(func(k, v []byte) error {
+			var layer Layer
+			if err := json.Unmarshal(v, &layer); err != nil {
+				return err
+			}
+			docker.layers[layer.Id] = layer
+			return nil
+		}); err != nil {
+			return err
+		}
+		return tx.Bucket(containersBucket).ForEach(func(k, v []byte) error {
+			var container Container
+			if err := json.Unmarshal(v, &container); err != nil {
+				return err
+			}
+			container.Running = false
+			for i, layer := range container.Layers {
+				if stored, exists := docker.layers[layer.Id]; exists {
+					container.Layers[i] = stored
+				}
+			}
+			docker.containers[container.Id] = &container
+			return nil
+		})
+	})
+}